@@ -0,0 +1,86 @@
+// Package logging builds the structured logger shared by the TCCHAT server
+// and client: a log/slog logger over stderr or, if configured, a rotating
+// log file, built once here instead of separately in each program.
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// rotatingWriter is an io.Writer backing the log file: once the file grows
+// past maxBytes, the current contents are renamed to path+".1" (overwriting
+// any previous rotation) and a fresh file is opened in its place.
+type rotatingWriter struct {
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+}
+
+// newRotatingWriter opens path for appending, creating it if necessary, and
+// returns a writer that rotates it once it exceeds maxBytes.
+func newRotatingWriter(path string, maxBytes int64) (*rotatingWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rotatingWriter{path: path, maxBytes: maxBytes, file: f, size: info.Size()}, nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	if w.size+int64(len(p)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, renames it to path+".1", and opens a
+// fresh file at path.
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.size = 0
+	return nil
+}
+
+// New builds a structured logger from the given flag values: format selects
+// between human-readable text and JSON, and, if logFile is non-empty,
+// output goes to a rotating file instead of stderr.
+func New(format, logFile string, maxSizeMB int64) (*slog.Logger, error) {
+	var w io.Writer = os.Stderr
+	if logFile != "" {
+		rw, err := newRotatingWriter(logFile, maxSizeMB*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+		w = rw
+	}
+
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, nil)
+	} else {
+		handler = slog.NewTextHandler(w, nil)
+	}
+	return slog.New(handler), nil
+}
@@ -0,0 +1,141 @@
+// Package proto implements the TCCHAT wire protocol: a versioned,
+// tab-delimited, newline-terminated framing layer shared by the client and
+// the server. It replaces the ad hoc strings.Split/strings.Replace parsing
+// that used to live in both programs with a single place to encode and
+// decode frames.
+package proto
+
+import (
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+// Version is the wire protocol version this build of TCCHAT speaks. Peers
+// exchange it during the TCCHAT_HELLO handshake and disconnect cleanly
+// instead of guessing when it doesn't match.
+const Version = "1"
+
+// Command identifies the kind of frame a Frame carries.
+type Command string
+
+// The full set of frame commands exchanged between client and server.
+const (
+	Hello      Command = "TCCHAT_HELLO"
+	Auth       Command = "TCCHAT_AUTH"
+	AuthOK     Command = "TCCHAT_AUTH_OK"
+	AuthFail   Command = "TCCHAT_AUTH_FAIL"
+	Register   Command = "TCCHAT_REGISTER"
+	Welcome    Command = "TCCHAT_WELCOME"
+	Message    Command = "TCCHAT_MESSAGE"
+	Bcast      Command = "TCCHAT_BCAST"
+	Join       Command = "TCCHAT_JOIN"
+	Part       Command = "TCCHAT_PART"
+	PM         Command = "TCCHAT_PM"
+	List       Command = "TCCHAT_LIST"
+	UserIn     Command = "TCCHAT_USERIN"
+	UserOut    Command = "TCCHAT_USEROUT"
+	Error      Command = "TCCHAT_ERROR"
+	Disconnect Command = "TCCHAT_DISCONNECT"
+	Shutdown   Command = "TCCHAT_SERVER_SHUTDOWN"
+)
+
+// Frame is a decoded protocol line: a command and its tab-delimited
+// arguments.
+type Frame struct {
+	Command Command
+	Args    []string
+}
+
+// Arg returns the i-th argument, or "" if the frame doesn't have one.
+func (f Frame) Arg(i int) string {
+	if i < 0 || i >= len(f.Args) {
+		return ""
+	}
+	return f.Args[i]
+}
+
+// Body re-joins every argument from index onwards with tabs, for a command
+// whose final argument is free-form text that may itself contain a literal
+// tab (chat message bodies, mainly).
+func (f Frame) Body(index int) string {
+	if index >= len(f.Args) {
+		return ""
+	}
+	return strings.Join(f.Args[index:], "\t")
+}
+
+// Conn reads and writes TCCHAT frames over a tab-delimited, newline
+// terminated textproto connection.
+type Conn struct {
+	*textproto.Conn
+}
+
+// NewConn wraps rwc in a Conn ready to exchange frames.
+func NewConn(rwc io.ReadWriteCloser) *Conn {
+	return &Conn{Conn: textproto.NewConn(rwc)}
+}
+
+// ReadFrame reads one protocol line and decodes it into a Frame.
+func (c *Conn) ReadFrame() (Frame, error) {
+	line, err := c.ReadLine()
+	if err != nil {
+		return Frame{}, err
+	}
+	fields := strings.Split(line, "\t")
+	return Frame{Command: Command(fields[0]), Args: fields[1:]}, nil
+}
+
+// WriteFrame writes cmd and args as a single tab-delimited protocol line.
+func (c *Conn) WriteFrame(cmd Command, args ...string) error {
+	return c.PrintfLine("%s", strings.Join(append([]string{string(cmd)}, args...), "\t"))
+}
+
+// EncodeFrame renders cmd and args exactly as WriteFrame would, without
+// requiring a live connection, so a frame can be queued for later delivery
+// (the server hands frames to per-client outbound channels rather than
+// writing them inline).
+func EncodeFrame(cmd Command, args ...string) []byte {
+	return []byte(strings.Join(append([]string{string(cmd)}, args...), "\t") + "\r\n")
+}
+
+// Handshake writes a TCCHAT_HELLO announcing Version, reads the peer's, and
+// reports whether both sides speak the same protocol version. Callers
+// should close the connection on a false result or error rather than
+// guessing at frames the peer may never send.
+func Handshake(c *Conn) (bool, error) {
+	if err := c.WriteFrame(Hello, Version); err != nil {
+		return false, err
+	}
+	frame, err := c.ReadFrame()
+	if err != nil {
+		return false, err
+	}
+	if frame.Command != Hello {
+		return false, fmt.Errorf("proto: expected %s, got %q", Hello, frame.Command)
+	}
+	return frame.Arg(0) == Version, nil
+}
+
+// RegisterMsg is the TCCHAT_REGISTER frame a client sends once
+// authentication has already succeeded. Username is the name the client
+// asks for; the TCCHAT server registers the connection under its
+// authenticated identity instead.
+type RegisterMsg struct {
+	Username string
+}
+
+// Encode writes m as a TCCHAT_REGISTER frame.
+func (m RegisterMsg) Encode(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s\t%s\n", Register, m.Username)
+	return err
+}
+
+// DecodeRegisterMsg extracts a RegisterMsg from an already-decoded Frame.
+func DecodeRegisterMsg(f Frame) (RegisterMsg, error) {
+	if f.Command != Register || len(f.Args) < 1 {
+		return RegisterMsg{}, fmt.Errorf("proto: not a %s frame", Register)
+	}
+	return RegisterMsg{Username: f.Arg(0)}, nil
+}
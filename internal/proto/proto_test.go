@@ -0,0 +1,182 @@
+package proto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestFrameArgAndBody(t *testing.T) {
+	f := Frame{Command: Bcast, Args: []string{"general", "alice", "hello", "world"}}
+
+	if got := f.Arg(0); got != "general" {
+		t.Errorf("Arg(0) = %q, want %q", got, "general")
+	}
+	if got := f.Arg(5); got != "" {
+		t.Errorf("Arg(5) out of range = %q, want \"\"", got)
+	}
+	if got := f.Body(2); got != "hello\tworld" {
+		t.Errorf("Body(2) = %q, want %q", got, "hello\tworld")
+	}
+	if got := f.Body(10); got != "" {
+		t.Errorf("Body(10) out of range = %q, want \"\"", got)
+	}
+}
+
+func TestWriteFrameReadFrameRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	cc := NewConn(client)
+	sc := NewConn(server)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cc.WriteFrame(Bcast, "general", "alice", "hello\tworld")
+	}()
+
+	frame, err := sc.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+
+	if frame.Command != Bcast {
+		t.Errorf("Command = %q, want %q", frame.Command, Bcast)
+	}
+	if got, want := frame.Arg(0), "general"; got != want {
+		t.Errorf("Arg(0) = %q, want %q", got, want)
+	}
+	if got, want := frame.Body(2), "hello\tworld"; got != want {
+		t.Errorf("Body(2) = %q, want %q", got, want)
+	}
+}
+
+func TestEncodeFrameMatchesWriteFrameTerminator(t *testing.T) {
+	got := EncodeFrame(Bcast, "general", "alice", "hello")
+	want := string(Bcast) + "\tgeneral\talice\thello\r\n"
+	if string(got) != want {
+		t.Errorf("EncodeFrame = %q, want %q (must match WriteFrame's \\r\\n terminator)", got, want)
+	}
+}
+
+// tcpPipe returns two ends of a real loopback TCP connection. Unlike
+// net.Pipe, writes are kernel-buffered, so both ends can run Handshake (which
+// writes before it reads) at the same time without deadlocking each other -
+// matching how client and server actually handshake in production.
+func tcpPipe(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	server = <-accepted
+	return client, server
+}
+
+func TestHandshakeMatchingVersion(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	cc := NewConn(client)
+	sc := NewConn(server)
+
+	results := make(chan bool, 2)
+	errs := make(chan error, 2)
+	go func() {
+		ok, err := Handshake(cc)
+		results <- ok
+		errs <- err
+	}()
+	go func() {
+		ok, err := Handshake(sc)
+		results <- ok
+		errs <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Handshake: %v", err)
+		}
+		if ok := <-results; !ok {
+			t.Errorf("Handshake ok = false, want true")
+		}
+	}
+}
+
+func TestHandshakeRejectsWrongCommand(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	cc := NewConn(client)
+	sc := NewConn(server)
+
+	go func() {
+		sc.ReadFrame() // consume the HELLO the client sends
+		sc.WriteFrame(Auth, Version)
+	}()
+
+	if _, err := Handshake(cc); err == nil {
+		t.Fatal("Handshake with a non-HELLO peer frame: got nil error, want one")
+	}
+}
+
+func TestRegisterMsgDecode(t *testing.T) {
+	f := Frame{Command: Register, Args: []string{"alice"}}
+
+	msg, err := DecodeRegisterMsg(f)
+	if err != nil {
+		t.Fatalf("DecodeRegisterMsg: %v", err)
+	}
+	if msg.Username != "alice" {
+		t.Errorf("Username = %q, want %q", msg.Username, "alice")
+	}
+
+	if _, err := DecodeRegisterMsg(Frame{Command: Auth, Args: []string{"alice"}}); err == nil {
+		t.Error("DecodeRegisterMsg with wrong command: got nil error, want one")
+	}
+	if _, err := DecodeRegisterMsg(Frame{Command: Register}); err == nil {
+		t.Error("DecodeRegisterMsg with no args: got nil error, want one")
+	}
+}
+
+func TestRegisterMsgEncodeDecodeRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (RegisterMsg{Username: "alice"}).Encode(&buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	fields := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\t"))
+	f := Frame{Command: Command(fields[0])}
+	for _, arg := range fields[1:] {
+		f.Args = append(f.Args, string(arg))
+	}
+
+	msg, err := DecodeRegisterMsg(f)
+	if err != nil {
+		t.Fatalf("DecodeRegisterMsg: %v", err)
+	}
+	if msg.Username != "alice" {
+		t.Errorf("Username = %q, want %q", msg.Username, "alice")
+	}
+}
@@ -1,66 +1,115 @@
 package main
 
 import (
-	"bufio"   // Buffered I/O package to read/write to our tcp connection
-	"fmt"     // Formatted I/O package for printing to the connection or console
-	"log"     // Logging package to handle errors more cleanly
-	"net"     // Network I/O package for our TCP/IP connection
-	"os"      // OS package used for exiting when errors occur and reading lines during execution
-	"strconv" // Conversion package to and from strings used to verify given arguments are integers
-	"strings" // Package to manipulate UTF-8 encoded strings
-	"time"    // Package for measuring and displaying time (used in the net.DialTimeout call)
+	"bufio"       // Buffered I/O package for the chat transcript and reading stdin
+	"crypto/tls"  // TLS transport used when connecting with -tls
+	"crypto/x509" // Certificate pool used to verify the server with -ca
+	"flag"        // Command line flag parsing
+	"fmt"         // Formatted I/O package for printing to the console
+	"log/slog"    // Structured logging for operational/connection events
+	"net"         // Network I/O package for our TCP/IP connection
+	"os"          // OS package used for exiting when errors occur and reading lines during execution
+	"strconv"     // Conversion package to and from strings used to verify given arguments are integers
+	"strings"     // Package to manipulate UTF-8 encoded strings
+	"sync"        // Guards currentRoom against the reader/input goroutine race
+	"time"        // Package for measuring and displaying time (used in the net.DialTimeout call)
+
+	"github.com/MaxMichel2/TCChat-Golang/internal/logging" // Shared structured-logger construction
+	"github.com/MaxMichel2/TCChat-Golang/internal/proto"   // TCCHAT wire protocol: framing, versioning, typed messages
 )
 
 var quit = false                                     // Boolean to track disconnecting
 var defaultIP = "127.0.0.1"                          // This computer
 var defaultPort = "8081"                             // Default port
+var myUsername string                                // Username this client registered with
 var filename = fmt.Sprintf("TCCHAT_%d", os.Getpid()) // Unique filename for each client
 var file, _ = os.Create(filename + ".txt")           // Text file to display the Chat
-var logger = bufio.NewWriter(file)                   // Logger used to write to "TCChat.txt"
+var transcript = bufio.NewWriter(file)               // Writer used to save the chat transcript to "TCCHAT_<pid>.txt"
+
+// logger is the client's structured logger for connection/operational
+// events, configured in main from the -log-format/-log-file/-log-max-size
+// flags before anything else runs.
+var logger *slog.Logger
+
+// roomMu guards currentRoom, which the background frame-reader goroutine
+// writes (on TCCHAT_JOIN) and the foreground input loop reads when building
+// outgoing frames.
+var roomMu sync.Mutex
+var currentRoom = "general" // Room messages are sent to, kept in sync with TCCHAT_JOIN; access only through setCurrentRoom/getCurrentRoom
+
+// setCurrentRoom records the room named by a TCCHAT_JOIN frame that's about
+// this client.
+func setCurrentRoom(room string) {
+	roomMu.Lock()
+	currentRoom = room
+	roomMu.Unlock()
+}
 
-// Error checking that uses the log package to print the error and exit with status
-// code 1
+// getCurrentRoom returns the room most recently set by setCurrentRoom.
+func getCurrentRoom() string {
+	roomMu.Lock()
+	defer roomMu.Unlock()
+	return currentRoom
+}
+
+// credentials bundles the auth material the user supplied on the command
+// line, whichever form (bearer token or username/password) they chose.
+type credentials struct {
+	token    string
+	username string
+	password string
+}
+
+// Error checking that logs the error and exits with status code 1
 func errorCheck(e error) {
 	if e != nil {
-		log.Fatalln(e)
+		logger.Error(e.Error())
+		os.Exit(1)
 	}
 }
 
 func writeToFile(message string) {
-	_, err := logger.WriteString(message)
+	_, err := transcript.WriteString(message)
 	errorCheck(err)
-	logger.Flush()
+	transcript.Flush()
 }
 
 // Main function (executed first)
 func main() {
-	args := os.Args
-	// switch to check the arguments given.
-	// 1 argument means an IP address
-	// 2 arguments means an IP address and a port number
-	// else use localhost/127.0.0.1 and port 8081
-	switch len(args) {
-	case 2:
-		serverAddress := args[1]
-		runConn(serverAddress, defaultPort)
-	case 3:
-		serverAddress := args[1]
-		serverPort := args[2]
-		runConn(serverAddress, serverPort)
-	default:
-		runConn(defaultIP, defaultPort)
+	addr := flag.String("addr", defaultIP, "server address")
+	port := flag.String("port", defaultPort, "server port")
+	useTLS := flag.Bool("tls", false, "connect over TLS")
+	certFile := flag.String("cert", "", "client TLS certificate (for mutual TLS)")
+	keyFile := flag.String("key", "", "client TLS private key (for mutual TLS)")
+	caFile := flag.String("ca", "", "CA certificate used to verify the server")
+	token := flag.String("token", "", "bearer token to authenticate with")
+	user := flag.String("user", "", "username to authenticate with (requires -pass)")
+	pass := flag.String("pass", "", "password to authenticate with (requires -user)")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logFile := flag.String("log-file", "", "file to write logs to, rotated once it exceeds -log-max-size (empty: stderr)")
+	logMaxSizeMB := flag.Int64("log-max-size", 10, "rotate -log-file after it exceeds this many megabytes")
+	flag.Parse()
+
+	var err error
+	logger, err = logging.New(*logFormat, *logFile, *logMaxSizeMB)
+	if err != nil {
+		fmt.Println("Failed to set up logging: ", err)
+		os.Exit(1)
 	}
-}
 
-// Will connect to the given IP and port if they are conform to what is expected (w.x.y.z and abcd)
-// else connect to the default server address
-func runConn(servAddr string, servPort string) {
-	if checkServerAddress(servAddr) && checkServerPort(servPort) {
-		setupChat(servAddr + ":" + servPort)
-	} else {
+	if !checkServerAddress(*addr) || !checkServerPort(*port) {
 		fmt.Println("Attempting connection to " + defaultIP + ":" + defaultPort)
-		setupChat(defaultIP + ":" + defaultPort)
+		*addr, *port = defaultIP, defaultPort
 	}
+
+	var tlsConfig *tls.Config
+	if *useTLS {
+		cfg, err := buildClientTLSConfig(*certFile, *keyFile, *caFile)
+		errorCheck(err)
+		tlsConfig = cfg
+	}
+
+	setupChat(*addr+":"+*port, tlsConfig, credentials{token: *token, username: *user, password: *pass})
 }
 
 // Checks if the given string is a positive integer
@@ -96,46 +145,139 @@ func checkServerAddress(s string) bool {
 	return true
 }
 
-// Start a connection with a given server address
-func setupChat(servAddress string) {
-	// 3 second timeout in case the connection is slow or there is an error
-	conn, err := net.DialTimeout("tcp", servAddress, time.Duration(3*time.Second))
+// buildClientTLSConfig loads an optional client certificate/key pair (for
+// mutual TLS) and, if a CA certificate is supplied, configures the pool used
+// to verify the server's certificate.
+func buildClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		caCert, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to parse CA certificate: %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// Start a connection with a given server address, optionally over TLS,
+// perform the TCCHAT_HELLO handshake, authenticate, and hand off to the
+// interactive client
+func setupChat(servAddress string, tlsConfig *tls.Config, creds credentials) {
+	var conn net.Conn
+	var err error
+
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 3 * time.Second}, "tcp", servAddress, tlsConfig)
+	} else {
+		// 3 second timeout in case the connection is slow or there is an error
+		conn, err = net.DialTimeout("tcp", servAddress, time.Duration(3*time.Second))
+	}
 
 	// Log the error if any
 	if err != nil {
-		fmt.Println("Connection Error: ", err.Error())
+		logger.Error("connection error", "err", err)
+		return
+	}
+
+	pc := proto.NewConn(conn)
+	if ok, err := proto.Handshake(pc); err != nil || !ok {
+		logger.Error("handshake failed", "err", err)
+		conn.Close()
+		return
+	}
+
+	if !authenticate(pc, creds) {
+		conn.Close()
 		return
 	}
 
 	// Run the client on the established connection
-	runClient(conn)
+	runClient(pc)
 
 	// goroutine to read messages sent from the server
 	go func() {
 		for !quit {
-			message, err := bufio.NewReader(conn).ReadString('\n')
+			frame, err := pc.ReadFrame()
 			if err != nil { // If there is an error whilst reading the connection, close it
-				fmt.Println("Reader error: ", err)
+				logger.Info("connection closed", "err", err)
 				if e := conn.Close(); e == nil {
-					fmt.Println("Closing connection...")
 					quit = true
 					conn.Close()
-					fmt.Println("Connection closed")
 				}
 				break
 			}
-			protocolToMessage(conn, message) // Translate TCCHAT protocol messages to strings
+			protocolToMessage(pc, frame) // Translate TCCHAT frames to strings
 		}
 	}()
 
 	// While loop to send messages to the server
 	for !quit {
-		messageToProtocol(conn) // Translate strings to TCCHAT protocol messages
+		messageToProtocol(pc) // Translate strings to TCCHAT frames
+	}
+}
+
+// authenticate sends a TCCHAT_AUTH frame built from the supplied
+// credentials and waits for the server's TCCHAT_AUTH_OK/TCCHAT_AUTH_FAIL
+// response, reporting whether authentication succeeded.
+func authenticate(pc *proto.Conn, creds credentials) bool {
+	var err error
+	switch {
+	case creds.token != "":
+		err = pc.WriteFrame(proto.Auth, "token", creds.token)
+	case creds.username != "" && creds.password != "":
+		err = pc.WriteFrame(proto.Auth, "password", creds.username, creds.password)
+	default:
+		// No credentials were given on the command line: fall back to a
+		// token derived from the local user, which a server started
+		// without -auth will accept as-is.
+		err = pc.WriteFrame(proto.Auth, "token", defaultToken())
+	}
+	if err != nil {
+		logger.Error("authentication error", "err", err)
+		return false
+	}
+
+	frame, err := pc.ReadFrame()
+	if err != nil {
+		logger.Error("authentication error", "err", err)
+		return false
+	}
+
+	if frame.Command != proto.AuthOK {
+		logger.Warn("authentication rejected by server")
+		return false
+	}
+
+	return true
+}
+
+// defaultToken derives a token from the local environment for clients that
+// were not given explicit credentials.
+func defaultToken() string {
+	if user := os.Getenv("USER"); user != "" {
+		return user
 	}
+	return "guest"
 }
 
-// Send specific information over the established connection 'conn'
-func runClient(conn net.Conn) {
+// Send specific information over the established connection
+func runClient(pc *proto.Conn) {
 	// Get the users desired username
 	writeToFile("Enter username: ")
 	fmt.Print("Enter username: ")
@@ -143,63 +285,71 @@ func runClient(conn net.Conn) {
 	scanner := bufio.NewScanner(os.Stdin)
 	if scanner.Scan() {
 		username := scanner.Text()
+		myUsername = username
 		// Send the given username to the server
 		writeToFile(username + "\r\n")
-		fmt.Fprintf(conn, "TCCHAT_REGISTER\t"+username+"\n")
+		pc.WriteFrame(proto.Register, username)
 	}
 
 	// Read the response from the server (We know from the protocol that it will be the server name)
-	mess, _ := bufio.NewReader(conn).ReadString('\n')
-
-	// Format the received string to get the server name
-	mess = fmt.Sprintf("%s\t", mess)
-	servName := strings.Split(mess, "\t")
+	frame, _ := pc.ReadFrame()
 
 	// Print welcome message
-	writeToFile("Welcome to: " + strings.Replace(servName[1], "\n", "", -1) + "\r\n")
-	fmt.Println("Welcome to: " + strings.Replace(servName[1], "\n", "", -1))
-}
-
-// Take a string of the form "TCCHAT_XXX..." and display the appropriate message
-func protocolToMessage(conn net.Conn, s string) {
-	// Replace "\n" in s by "" as many times as necessary (-1)
-	// if -1 was 'n', it would replace "\n" only 'n' times, no more
-	s = strings.Replace(s, "\n", "", -1)
-	message := strings.Split(s, "\t") // Split s into an array of strings by "\t"
-	
-	if len(message) > 3 { // If other users send a tab, it will be split so concatenate them
-		temp := ""
-		for i := 2; i < len(message); i++ {
-			temp += message[i]
-			temp += "\t"
-		}
-		message[2] = temp
-	} 
+	writeToFile("Welcome to: " + frame.Arg(0) + "\r\n")
+	fmt.Println("Welcome to: " + frame.Arg(0))
+}
+
+// Take a decoded TCCHAT frame and display the appropriate message
+func protocolToMessage(pc *proto.Conn, frame proto.Frame) {
 	// Check which protocol message was received and display accordingly
-	switch message[0] {
-	case "TCCHAT_USERIN":
-		writeToFile(message[1] + " has joined the chat." + "\r\n")
-		fmt.Println(message[1] + " has joined the chat.")
-	case "TCCHAT_USEROUT":
-		writeToFile(message[1] + " has left the chat." + "\r\n")
-		fmt.Println(message[1] + " has left the chat.")
-	case "TCCHAT_BCAST":
-		writeToFile(message[1] + ": " + message[2] + "\r\n")
-		fmt.Println(message[1] + ": " + message[2])
+	switch frame.Command {
+	case proto.UserIn:
+		writeToFile(frame.Arg(0) + " has joined the chat." + "\r\n")
+		fmt.Println(frame.Arg(0) + " has joined the chat.")
+	case proto.UserOut:
+		writeToFile(frame.Arg(0) + " has left the chat." + "\r\n")
+		fmt.Println(frame.Arg(0) + " has left the chat.")
+	case proto.Bcast: // Arg(0) is the room, Arg(1) the sender, Body(2) the message
+		line := "[" + frame.Arg(0) + "] " + frame.Arg(1) + ": " + frame.Body(2)
+		writeToFile(line + "\r\n")
+		fmt.Println(line)
+	case proto.Join: // Arg(0) is the room, Arg(1) the user who joined it
+		if frame.Arg(1) == myUsername {
+			setCurrentRoom(frame.Arg(0))
+		}
+		line := frame.Arg(1) + " joined " + frame.Arg(0)
+		writeToFile(line + "\r\n")
+		fmt.Println(line)
+	case proto.Part: // Arg(0) is the room, Arg(1) the user who left it
+		line := frame.Arg(1) + " left " + frame.Arg(0)
+		writeToFile(line + "\r\n")
+		fmt.Println(line)
+	case proto.PM: // Arg(0) is the sender, Body(1) the message
+		line := "[PM] " + frame.Arg(0) + ": " + frame.Body(1)
+		writeToFile(line + "\r\n")
+		fmt.Println(line)
+	case proto.List:
+		line := "List: " + frame.Arg(0)
+		writeToFile(line + "\r\n")
+		fmt.Println(line)
+	case proto.Shutdown:
+		writeToFile("Server is shutting down." + "\r\n")
+		fmt.Println("Server is shutting down.")
+		quit = true
+		pc.Close()
 	default: // Faulty connection so should be terminated
-		if err := conn.Close(); err == nil {
+		if err := pc.Close(); err == nil {
 			quit = true
-			conn.Close()
 		}
 	}
 }
 
-// Take input message and parse it to TCCHAT protocol
-func messageToProtocol(conn net.Conn) {
+// Take input message and parse it to a TCCHAT frame
+func messageToProtocol(pc *proto.Conn) {
 	reader := bufio.NewReader(os.Stdin)
 	cliMess, _ := reader.ReadString('\n')
 	cliMess = strings.TrimRight(cliMess, "\r\n")
-	
+
 	// Check the message contains at most 140 characters
 	if len(cliMess) > 140 {
 		fmt.Println("Message should contain at most 140 characters")
@@ -207,25 +357,61 @@ func messageToProtocol(conn net.Conn) {
 		fmt.Println("String cannot contain a \n character")
 	} else {
 		writeToFile("Me: " + cliMess + "\r\n")
-		// If the user types !q, disconnect him, else send the message
+		// If the user types !q, disconnect him, else parse slash-commands or
+		// send a plain message to the current room
 		if cliMess == "!q" {
 			quit = true // Set quit to true to stop the loops
 			writeToFile("Leaving the chat..." + "\r\n")
 			fmt.Println("Leaving the chat...")
-			disconnect(conn)
+			disconnect(pc)
 		} else {
-			fmt.Fprintf(conn, "TCCHAT_MESSAGE\t"+cliMess+"\n")
+			sendCommand(pc, cliMess)
 		}
 	}
 }
 
+// sendCommand parses a slash-command (/join, /part, /list, /msg, /who) into
+// its TCCHAT frame, or treats cliMess as a plain message to the current room
+// if it isn't one.
+func sendCommand(pc *proto.Conn, cliMess string) {
+	switch {
+	case strings.HasPrefix(cliMess, "/join "):
+		room := strings.TrimSpace(strings.TrimPrefix(cliMess, "/join "))
+		pc.WriteFrame(proto.Join, room)
+
+	case cliMess == "/part" || strings.HasPrefix(cliMess, "/part "):
+		room := strings.TrimSpace(strings.TrimPrefix(cliMess, "/part"))
+		if room == "" {
+			room = getCurrentRoom()
+		}
+		pc.WriteFrame(proto.Part, room)
+
+	case cliMess == "/list":
+		pc.WriteFrame(proto.List)
+
+	case cliMess == "/who":
+		pc.WriteFrame(proto.List, getCurrentRoom())
+
+	case strings.HasPrefix(cliMess, "/msg "):
+		rest := strings.TrimPrefix(cliMess, "/msg ")
+		parts := strings.SplitN(rest, " ", 2)
+		if len(parts) < 2 {
+			fmt.Println("Usage: /msg <user> <message>")
+			return
+		}
+		pc.WriteFrame(proto.PM, parts[0], parts[1])
+
+	default:
+		pc.WriteFrame(proto.Message, getCurrentRoom(), cliMess)
+	}
+}
+
 // Disconnect the client and close the connection
-func disconnect(conn net.Conn) {
-	_, err := fmt.Fprintf(conn, "TCCHAT_DISCONNECT\n")
-	if err != nil {
-		fmt.Println(err)
+func disconnect(pc *proto.Conn) {
+	if err := pc.WriteFrame(proto.Disconnect); err != nil {
+		logger.Error("disconnect error", "err", err)
 	}
-	conn.Close()
+	pc.Close()
 	writeToFile("Succesfully left the chat.\r\n")
 	fmt.Print("Succesfully left the chat.")
 	os.Exit(0) // Clean exit of the code
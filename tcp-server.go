@@ -1,26 +1,183 @@
 package main
 
 import (
-	"bufio"   // Buffered I/O package to read/write to our tcp connection
-	"fmt"     // Formatted I/O package for printing to the connection or console
-	"log"     // Logging package to handle errors more cleanly
-	"net"     // Network I/O package for our TCP/IP connection
-	"os"      // OS package used for exiting when errors occur and reading lines during execution
-	"strconv" // Conversion package to and from strings used to verify given arguments are integers
-	"strings" // Package to manipulate UTF-8 encoded strings
-	"sync"    // Syncronization package used for Mutex locks
+	"bufio"         // Buffered I/O package used to scan the credentials file
+	"context"       // Carries the shutdown signal down into the accept loop
+	"crypto/subtle" // Constant-time password comparison
+	"crypto/tls"    // TLS transport used when the server is started with -tls
+	"crypto/x509"   // Certificate pool used to verify client certificates with -ca
+	"flag"          // Command line flag parsing
+	"fmt"           // Formatted I/O package for printing to the console and formatting errors
+	"log/slog"      // Structured logging for operational/connection events
+	"net"           // Network I/O package for our TCP/IP connection
+	"os"            // OS package used for exiting when errors occur and reading lines during execution
+	"os/signal"     // Turns SIGINT/SIGTERM into a cancelable context for graceful shutdown
+	"strconv"       // Conversion package to and from strings used to verify given arguments are integers
+	"strings"       // Package to manipulate UTF-8 encoded strings
+	"syscall"       // SIGINT/SIGTERM signal numbers
+	"time"          // Package for measuring and displaying time (used in the write deadline)
+
+	"github.com/MaxMichel2/TCChat-Golang/internal/logging" // Shared structured-logger construction
+	"github.com/MaxMichel2/TCChat-Golang/internal/proto"   // TCCHAT wire protocol: framing, versioning, typed messages
 )
 
-var connMap map[string]net.Conn // map usernames (string) to given connections (net.Conn)
-var userMap map[net.Conn]string // Map connections (net.Conn) to given usernames (string)
-var mutex sync.Mutex            // Mutex lock used during the sending and receiving of messages
-var closeServer = false         // Boolean to know whether or not the server should shut down or not
+// logger is the server's structured logger, configured in main from the
+// -log-format/-log-file/-log-max-size flags before anything else runs.
+var logger *slog.Logger
+
+// client represents a single connected user together with the queue used to
+// hand it outgoing frames. Only the hub goroutine is allowed to read or
+// write a client's username; conn, pc and outbound are safe to use from the
+// client's own reader/writer goroutines.
+type client struct {
+	hub           *hub
+	conn          net.Conn
+	pc            *proto.Conn // Frame-level view of conn, shared by the reader goroutine and the handshake
+	username      string
+	identity      string      // Identity returned by the Authenticator once authenticate succeeds
+	authenticated bool        // Whether TCCHAT_AUTH has succeeded for this connection
+	room          string      // Room the client currently belongs to, empty until joined
+	outbound      chan []byte // Buffered queue of raw protocol frames waiting to be written
+	dropped       bool        // Set by dropClient; makes later send calls on this client a no-op
+}
+
+// event pairs a decoded protocol frame with the client it was received
+// from, so the hub can process it without needing to touch shared state
+// itself.
+type event struct {
+	client *client
+	frame  proto.Frame
+}
+
+// hub owns every piece of shared chat state (the set of connected clients)
+// and is the only goroutine allowed to read or write it. Every other
+// goroutine talks to it exclusively through the channels below instead of
+// sharing memory directly.
+type hub struct {
+	clients      map[*client]bool
+	rooms        map[string]map[*client]bool // Room name -> its current members
+	register     chan *client
+	unregister   chan *client
+	inbound      chan event
+	auth         Authenticator
+	bufferSize   int           // Size of each client's outbound queue before it's considered behind
+	writeTimeout time.Duration // Deadline given to a single write before the client is evicted
+}
+
+// defaultRoom is the room every client is placed in once it registers.
+const defaultRoom = "general"
+
+// newHub allocates a hub with its channels and client set ready to use.
+// Every connection accepted by this hub is authenticated against auth
+// before it is allowed to register. Clients that fall more than bufferSize
+// frames behind, or that take longer than writeTimeout to accept a single
+// write, are evicted rather than allowed to stall the rest of the chat.
+func newHub(auth Authenticator, bufferSize int, writeTimeout time.Duration) *hub {
+	return &hub{
+		clients:      make(map[*client]bool),
+		rooms:        make(map[string]map[*client]bool),
+		register:     make(chan *client),
+		unregister:   make(chan *client),
+		inbound:      make(chan event),
+		auth:         auth,
+		bufferSize:   bufferSize,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// Authenticator verifies client-supplied credentials and reports the
+// identity the connection should be registered under. Implementations are
+// free to treat that identity however they like; the hub just trusts it in
+// place of the client-supplied nickname.
+type Authenticator interface {
+	// AuthenticateToken checks a bearer token and returns the identity it
+	// maps to, or reports false if the token is unknown.
+	AuthenticateToken(token string) (identity string, ok bool)
+	// AuthenticatePassword checks a username/password pair and returns the
+	// identity it maps to, or reports false if the credentials are invalid.
+	AuthenticatePassword(username, password string) (identity string, ok bool)
+}
+
+// noAuth is the Authenticator used when the server is started without
+// -auth: it accepts any non-empty token or username and uses it directly as
+// the identity, preserving the original trust-the-client behaviour.
+type noAuth struct{}
+
+func (noAuth) AuthenticateToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+func (noAuth) AuthenticatePassword(username, password string) (string, bool) {
+	if username == "" {
+		return "", false
+	}
+	return username, true
+}
+
+// fileAuthenticator checks incoming credentials against username/password
+// pairs and bearer tokens loaded from a credentials file.
+type fileAuthenticator struct {
+	passwords map[string]string // username -> password
+	tokens    map[string]string // token -> identity
+}
 
-// Error checking that uses the log package to print the error and exit with status
-// code 1
+// loadAuthFile reads a credentials file where each line is either
+// "user:<username>:<password>" or "token:<token>:<identity>" and returns an
+// Authenticator backed by its contents. Blank lines and lines starting with
+// "#" are ignored.
+func loadAuthFile(path string) (Authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &fileAuthenticator{passwords: make(map[string]string), tokens: make(map[string]string)}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		switch fields[0] {
+		case "user":
+			a.passwords[fields[1]] = fields[2]
+		case "token":
+			a.tokens[fields[1]] = fields[2]
+		}
+	}
+
+	return a, scanner.Err()
+}
+
+func (a *fileAuthenticator) AuthenticateToken(token string) (string, bool) {
+	identity, ok := a.tokens[token]
+	return identity, ok
+}
+
+func (a *fileAuthenticator) AuthenticatePassword(username, password string) (string, bool) {
+	want, ok := a.passwords[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(password)) != 1 {
+		return "", false
+	}
+	return username, true
+}
+
+// Error checking that logs the error and exits with status code 1
 func errorCheck(e error) {
 	if e != nil {
-		log.Fatalln(e)
+		logger.Error(e.Error())
+		os.Exit(1)
 	}
 }
 
@@ -32,150 +189,417 @@ func checkServerPort(s string) bool {
 	return false
 }
 
+// buildServerTLSConfig loads the server's certificate/key pair and, if a CA
+// certificate is supplied, configures mutual TLS by requiring and verifying
+// client certificates against it.
+func buildServerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile != "" {
+		caCert, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to parse CA certificate: %s", caFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
 // Main function (executed first)
 func main() {
 
-	fmt.Println("Launching server...")
+	portFlag := flag.String("port", "8081", "port to listen on")
+	useTLS := flag.Bool("tls", false, "serve over TLS")
+	certFile := flag.String("cert", "", "TLS certificate file (required with -tls)")
+	keyFile := flag.String("key", "", "TLS private key file (required with -tls)")
+	caFile := flag.String("ca", "", "CA certificate used to verify client certificates (enables mutual TLS)")
+	authFile := flag.String("auth", "", "credentials file to authenticate clients against (defaults to accepting any identity)")
+	bufferSize := flag.Int("buffer", 64, "number of queued frames a client may fall behind by before it is evicted")
+	writeTimeout := flag.Duration("write-timeout", 5*time.Second, "deadline for a single write before a slow client is evicted")
+	drainTimeout := flag.Duration("shutdown-drain", 2*time.Second, "time given to flush queued frames to clients during a graceful shutdown")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logFile := flag.String("log-file", "", "file to write logs to, rotated once it exceeds -log-max-size (empty: stderr)")
+	logMaxSizeMB := flag.Int64("log-max-size", 10, "rotate -log-file after it exceeds this many megabytes")
+	flag.Parse()
 
-	connMap = make(map[string]net.Conn) // Allocate and initialise a map with no given size
-	userMap = make(map[net.Conn]string) // Allocate and initialise a map with no given size
+	var err error
+	logger, err = logging.New(*logFormat, *logFile, *logMaxSizeMB)
+	if err != nil {
+		fmt.Println("Failed to set up logging: ", err)
+		os.Exit(1)
+	}
 
-	args := os.Args
+	logger.Info("launching server")
 
-	var connPort = ""
+	if !checkServerPort(*portFlag) { // Verify the given port number is valid, else use 8081 by default
+		*portFlag = "8081"
+	}
 
-	if len(args) == 2 && checkServerPort(args[1]) { // Verify a port number is given and check it
-		connPort = args[1]
-	} else { // Else use port 8081 by default
-		connPort = "8081"
+	var auth Authenticator = noAuth{}
+	if *authFile != "" {
+		loaded, err := loadAuthFile(*authFile)
+		errorCheck(err)
+		auth = loaded
 	}
 
-	fmt.Print("IP address: ")
-	getPreferredIPAddress() // Prints out the preferred IP address of the specific computer
-	fmt.Println("Port number: " + connPort)
+	h := newHub(auth, *bufferSize, *writeTimeout)
 
-	// Listens for connection requests
-	ln, err := net.Listen("tcp", ":"+connPort)
+	shutdown := make(chan struct{})
+	hubDone := make(chan struct{})
+	go func() {
+		h.run(shutdown, *drainTimeout)
+		close(hubDone)
+	}()
 
-	// Error check
-	if err != nil {
-		fmt.Println(err)
-		return
+	logger.Info("server listening", "address", getPreferredIPAddress(), "port", *portFlag)
+
+	tcpLn, err := net.Listen("tcp", ":"+*portFlag)
+	errorCheck(err)
+
+	var ln net.Listener = keepAliveListener{tcpLn.(*net.TCPListener)}
+	if *useTLS { // Listen over TLS instead of plaintext TCP
+		tlsConfig, tlsErr := buildServerTLSConfig(*certFile, *keyFile, *caFile)
+		errorCheck(tlsErr)
+		ln = tls.NewListener(ln, tlsConfig)
 	}
 
-	// Defer (wait till surrounding functions have finished) the execution of ln.Close()
-	defer ln.Close()
+	// Turn SIGINT/SIGTERM into a cancelable context instead of dying mid-write
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		logger.Info("shutdown signal received, closing listener")
+		close(shutdown)
+		ln.Close()
+	}()
 
 	// Semi-infinite loop that accepts connections, checks for errors and executes a goroutine
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			fmt.Println("Accept error: ", err)
-			return
+			select {
+			case <-ctx.Done(): // Expected: the listener was closed as part of shutdown
+			default:
+				logger.Error("accept error", "err", err)
+			}
+			break
 		}
-		go connection(conn) // goroutine execution of the connection function concurrently
+		go h.serve(conn) // goroutine execution of the connection handling concurrently
 	}
+
+	<-hubDone
+	logger.Info("server stopped")
 }
 
 // UDP doesn't establish a connection and the destination doesn't need to exist. The function gets
 // the local IP address if it were to connect to that target address.
 // conn.LocalAddr().(*net.UPDAddr) get the preferred (obviously) outbound IP address
-func getPreferredIPAddress() {
+func getPreferredIPAddress() string {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		log.Fatal(err)
-	}
+	errorCheck(err)
 	defer conn.Close()
 
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	return localAddr.IP.String()
+}
 
-	os.Stdout.WriteString(localAddr.IP.String() + "\n") // Prints the IP address as a string
+// keepAliveListener wraps a TCP listener so every accepted connection has
+// keepalives enabled before it's handed off, matching the historical
+// net/http tcpKeepAliveListener pattern.
+type keepAliveListener struct {
+	*net.TCPListener
+}
+
+func (ln keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(30 * time.Second)
+	return conn, nil
 }
 
-//Connection function giving the machines to which it is connected (1), reading the messages
-// it receives via net.Conn, standard error check, string parsing from the client message,
-// mutex locking to handle the received message and unlocking afterwards.
-func connection(c net.Conn) {
-	fmt.Printf("Serving %s\n", c.RemoteAddr().String()) // (1)
+// serve wires up a freshly accepted connection: it exchanges the
+// TCCHAT_HELLO handshake, registers a client with the hub, starts its
+// dedicated writer goroutine, then blocks reading frames off the connection
+// until it errors out or is closed.
+func (h *hub) serve(conn net.Conn) {
+	logger.Info("serving connection", "remote", conn.RemoteAddr().String())
+
+	pc := proto.NewConn(conn)
+	if ok, err := proto.Handshake(pc); err != nil || !ok {
+		logger.Warn("handshake failed, closing connection", "remote", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+
+	c := &client{hub: h, conn: conn, pc: pc, outbound: make(chan []byte, h.bufferSize)}
+	h.register <- c
+
+	go c.writeLoop()
+	h.readLoop(c)
+}
 
+// readLoop reads protocol frames off the client's connection and forwards
+// each one to the hub for processing, until the connection errors out, at
+// which point the client is unregistered.
+func (h *hub) readLoop(c *client) {
 	for {
-		cliMess, err := bufio.NewReader(c).ReadString('\n')
+		frame, err := c.pc.ReadFrame()
 		if err != nil {
-			fmt.Println("Connection error: ", err)
+			logger.Info("connection closed", "remote", c.conn.RemoteAddr().String(), "err", err)
 			break
 		}
 
-		message := fmt.Sprintf("%s", cliMess)
-		mutex.Lock()
-		protocolToMessage(c, message)
-		mutex.Unlock()
-	}
-	
-	fmt.Println("Closing connection...")
-	var temp = userMap[c] // Temporary copy of the username associated to *c in userMap
-	delete(userMap, c)    // Delete the username associated to *c in userMap
-	delete(connMap, temp) // Delete the connection associated to the previously deleted username in connMap
-	c.Close()             // Connection closing if the for loop is exited
-	fmt.Println("Connection closed.")
-}
-
-// Convert TCCHAT protocol to actual messages
-func protocolToMessage(c net.Conn, s string) {
-	fmt.Print("Recieved: " + s)       // Used to verify what was being received
-	message := strings.Split(s, "\t") // Split the received message into an array of strings by \t
-	username := "" // Empty string that will contain the specified username
-	registerCount := 0 // Counter for the amount of times TCCHAT_REGISTER is received
-	
-	if len(message) > 1 { // If message has only one string in it, it's necessarily a disconnect call
-		// Replace "\n" in message by "" as many times as necessary (-1)
-		// if -1 was 'n', it would replace "\n" only 'n' times, no more
-		username = strings.Replace(message[1], "\n", "", -1)
-	}
-	
-	// Check if the connection has only sent 1 TCCHAT_REGISTER
-	if registerCount > 1 {
-		fmt.Println("Corrupted connection detected !")
-		c.Close()
-		fmt.Println("Connection closed")
-	}
-	// Prettier if else if loop checking the contents of message[0] which contains the prefix
-	// of the protocol message
-	switch message[0] {
-	case "TCCHAT_REGISTER": // A new user has joined the server
-		registerUser(c, username)
-		registerCount += 1 // Increment counter by 1
-		
-	case "TCCHAT_MESSAGE": // A message has been received from a connected client
-		sendMessageAll(c, message[1])
-
-	case "TCCHAT_DISCONNECT\n": // In case of a disconnect, the \n will still be part of the message
-		userDisconnect(userMap[c])
-		
+		h.inbound <- event{client: c, frame: frame}
+	}
+
+	h.unregister <- c
+}
+
+// writeLoop drains the client's outbound queue and writes each frame to the
+// underlying connection until the hub closes the channel. Every write is
+// given a fresh deadline so a client whose TCP buffer is stuck can't stall
+// this goroutine, or the hub, indefinitely; a failed or timed-out write
+// evicts the client instead.
+func (c *client) writeLoop() {
+	for frame := range c.outbound {
+		c.conn.SetWriteDeadline(time.Now().Add(c.hub.writeTimeout))
+		if _, err := c.conn.Write(frame); err != nil {
+			logger.Warn("write error, evicting slow client", "remote", c.conn.RemoteAddr().String(), "err", err)
+			c.hub.unregister <- c
+			return
+		}
+	}
+}
+
+// send queues a frame for delivery to the client without ever blocking the
+// caller. A client that is too far behind to keep its outbound buffer
+// drained is evicted outright, rather than left to silently miss frames,
+// since that's the symptom of a connection the server can no longer trust
+// to keep up. Once evicted, send is a no-op: a single hub action (join,
+// registration, a room broadcast) can call send on the same client more
+// than once, and c.outbound is already closed by the time a later call
+// runs.
+func (c *client) send(cmd proto.Command, args ...string) {
+	if c.dropped {
+		return
+	}
+	select {
+	case c.outbound <- proto.EncodeFrame(cmd, args...):
+	default:
+		logger.Warn("outbound buffer full, evicting slow client", "username", c.username)
+		c.hub.dropClient(c)
+	}
+}
+
+// run is the hub's main loop. It is the sole owner of h.clients and must
+// never be entered by more than one goroutine at a time. Closing shutdown
+// asks it to notify every connected client and return once they've been
+// given drainTimeout to receive that notice.
+func (h *hub) run(shutdown <-chan struct{}, drainTimeout time.Duration) {
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+
+		case c := <-h.unregister:
+			h.dropClient(c)
+
+		case e := <-h.inbound:
+			h.protocolToMessage(e.client, e.frame)
+
+		case <-shutdown:
+			h.broadcastShutdown(drainTimeout)
+			return
+		}
+	}
+}
+
+// broadcastShutdown tells every connected client the server is going away,
+// gives their writer goroutines drainTimeout to flush that notice, then
+// closes every remaining connection.
+func (h *hub) broadcastShutdown(drainTimeout time.Duration) {
+	for c := range h.clients {
+		c.send(proto.Shutdown)
+	}
+
+	time.Sleep(drainTimeout)
+
+	for c := range h.clients {
+		close(c.outbound)
+		c.conn.Close()
+	}
+	h.clients = make(map[*client]bool)
+}
+
+// dropClient removes a client from the hub and notifies the rest of the
+// chat that its user has left, if it ever registered a username.
+func (h *hub) dropClient(c *client) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	c.dropped = true
+	if c.room != "" {
+		h.partRoom(c, c.room)
+	}
+	close(c.outbound)
+	c.conn.Close()
+
+	if c.username != "" {
+		h.userDisconnect(c.username)
+	}
+}
+
+// Convert a decoded TCCHAT frame into the corresponding hub action
+func (h *hub) protocolToMessage(c *client, f proto.Frame) {
+	logger.Debug("frame received", "command", f.Command, "args", strings.Join(f.Args, "\t"))
+
+	switch f.Command {
+	case proto.Auth: // Credentials sent before registration is allowed
+		h.authenticate(c, f)
+
+	case proto.Register: // A new user has joined the server
+		if !c.authenticated {
+			logger.Warn("rejecting registration before authentication", "remote", c.conn.RemoteAddr().String())
+			h.dropClient(c)
+			return
+		}
+		if c.username != "" {
+			logger.Warn("rejecting duplicate registration", "username", c.username)
+			h.dropClient(c)
+			return
+		}
+		msg, err := proto.DecodeRegisterMsg(f)
+		if err != nil {
+			h.dropClient(c)
+			return
+		}
+		h.registerUser(c, msg)
+
+	case proto.Message: // A message has been received from a connected client, addressed to a room
+		if !c.authenticated {
+			h.dropClient(c)
+			return
+		}
+		h.sendMessageRoom(c, f.Arg(0), f.Body(1))
+
+	case proto.Join: // The client wants to move into (or create) a room
+		if !c.authenticated {
+			h.dropClient(c)
+			return
+		}
+		h.joinRoom(c, f.Arg(0))
+
+	case proto.Part: // The client wants to leave a room
+		if !c.authenticated {
+			h.dropClient(c)
+			return
+		}
+		h.partRoom(c, f.Arg(0))
+
+	case proto.PM: // A private message addressed to a single user
+		if !c.authenticated {
+			h.dropClient(c)
+			return
+		}
+		h.sendPrivateMessage(c, f.Arg(0), f.Body(1))
+
+	case proto.List: // Room given: list its members; no room: list every room
+		if !c.authenticated {
+			h.dropClient(c)
+			return
+		}
+		if len(f.Args) == 0 {
+			c.send(proto.List, h.listRooms())
+		} else {
+			c.send(proto.List, h.listRoomMembers(f.Arg(0)))
+		}
+
+	case proto.Disconnect:
+		h.dropClient(c)
+
 	default: // Message received is not of the correct form, close the connection
-		if err := c.Close(); err == nil {
-			c.Close()
+		h.dropClient(c)
+	}
+}
+
+// authenticate validates a TCCHAT_AUTH frame against the hub's Authenticator
+// and unlocks registration for the connection on success. A frame is either
+// "TCCHAT_AUTH\ttoken\t<token>" or "TCCHAT_AUTH\tpassword\t<user>\t<pass>".
+func (h *hub) authenticate(c *client, f proto.Frame) {
+	if len(f.Args) < 2 {
+		c.send(proto.AuthFail)
+		h.dropClient(c)
+		return
+	}
+
+	var identity string
+	var ok bool
+
+	switch f.Arg(0) {
+	case "token":
+		identity, ok = h.auth.AuthenticateToken(f.Arg(1))
+	case "password":
+		if len(f.Args) < 3 {
+			c.send(proto.AuthFail)
+			h.dropClient(c)
+			return
 		}
+		identity, ok = h.auth.AuthenticatePassword(f.Arg(1), f.Arg(2))
+	}
+
+	if !ok {
+		logger.Warn("authentication failed", "remote", c.conn.RemoteAddr().String())
+		c.send(proto.AuthFail)
+		h.dropClient(c)
+		return
 	}
+
+	c.authenticated = true
+	c.identity = identity
+	c.send(proto.AuthOK)
 }
 
-// Add the new user and linked connection to both the userMap and connMap
-func registerUser(conn net.Conn, username string) {
-	// Check if the username has already been used
-	newUsername := checkDuplicateUsername(username)
-	// Notify other users a new user has joined
-	userConnect(newUsername) // Called before adding the new user to the maps to prevent sending a 'joined' notification to himself (useless)
-	connMap[newUsername] = conn
-	userMap[conn] = newUsername
-	// fmt.Println(username + " joined the chat.") // Used to verify the reception of the username
-	conn.Write([]byte("TCCHAT_WELCOME\tTCChat G7\n")) // Send welcome to the new user
+// Name an already-registered client, using the identity established during
+// authentication rather than anything the client claims in the
+// TCCHAT_REGISTER frame itself, and place it in the default room
+func (h *hub) registerUser(c *client, _ proto.RegisterMsg) {
+	// Check if the identity has already been used
+	newUsername := h.checkDuplicateUsername(c.identity)
+	// Notify other users a new user has joined. c.username is still unset
+	// here, so userConnect's own check skips c when it walks h.clients.
+	h.userConnect(newUsername)
+	c.username = newUsername
+	c.send(proto.Welcome, "TCChat G7") // Send welcome to the new user
+	if c.dropped {                     // Evicted by the send above; don't put it back in a room
+		return
+	}
+	h.joinRoom(c, defaultRoom) // Every user starts out in the default room
 }
 
 // Change username to usernameN (N an integer) if username has already established a connection
-func checkDuplicateUsername(username string) string {
+func (h *hub) checkDuplicateUsername(username string) string {
 	// Count the times the username exists
 	occurencesOfUsername := 0
-	for _, value := range userMap {
-		if value == username {
+	for other := range h.clients {
+		if other.username == username {
 			occurencesOfUsername += 1
 		}
 	}
@@ -187,49 +611,126 @@ func checkDuplicateUsername(username string) string {
 	return username
 }
 
-// Range through all the connected users and notify them *username has joined
-func userConnect(username string) {
-	for key := range connMap {
-		connMap[key].Write([]byte("TCCHAT_USERIN\t" + username + "\n"))
+// Range through all the connected users and notify them *username has joined.
+// Clients that haven't finished registering yet (c.username still unset,
+// which includes the very client this notification is about) are skipped:
+// they're not listening for chat frames yet and shouldn't hear about
+// themselves joining.
+func (h *hub) userConnect(username string) {
+	for other := range h.clients {
+		if other.username == "" {
+			continue
+		}
+		other.send(proto.UserIn, username)
+	}
+}
+
+// Range through all the connected users and notify them *username has left.
+// See userConnect for why unregistered clients are skipped.
+func (h *hub) userDisconnect(username string) {
+	for other := range h.clients {
+		if other.username == "" {
+			continue
+		}
+		other.send(proto.UserOut, username)
+	}
+}
+
+// joinRoom moves a client into room, parting whichever room it was
+// previously in, and notifies the new room's members.
+func (h *hub) joinRoom(c *client, room string) {
+	if c.room == room {
+		return
+	}
+	if c.room != "" {
+		h.partRoom(c, c.room)
+	}
+
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[*client]bool)
 	}
+	h.rooms[room][c] = true
+	c.room = room
+
+	h.broadcastRoom(room, nil, proto.Join, room, c.username)
 }
 
-// Range through all the connected users and notify them *username has left
-func userDisconnect(username string) {
-	for key := range connMap {
-		connMap[key].Write([]byte("TCCHAT_USEROUT\t" + username + "\n"))
+// partRoom removes a client from room and notifies its remaining members.
+// The room itself is dropped once its last member leaves.
+func (h *hub) partRoom(c *client, room string) {
+	members := h.rooms[room]
+	if members == nil || !members[c] {
+		return
+	}
+
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+	}
+	if c.room == room {
+		c.room = ""
 	}
 
-	var temp = connMap[username] // Temporary copy of the connection associated to *username in connMap
-	delete(connMap, username)    // Delete the connection associated to *username in connMap
-	delete(userMap, temp)        // Delete the username associated to the previously deleted connection in userMap
-	serverShutdown(temp)         // Check whether or not to shutdown the server
+	h.broadcastRoom(room, nil, proto.Part, room, c.username)
 }
 
-// Broadcast received messages to all clients except the client that sent the message (useless)
-func sendMessageAll(conn net.Conn, mess string) {
-	for key := range connMap {
-		if connMap[key] != conn {
-			connMap[key].Write([]byte("TCCHAT_BCAST\t" + userMap[conn] + "\t" + mess + "\n"))
+// broadcastRoom sends cmd/args to every member of room except exclude (pass
+// nil to notify everyone in the room).
+func (h *hub) broadcastRoom(room string, exclude *client, cmd proto.Command, args ...string) {
+	for member := range h.rooms[room] {
+		if member != exclude {
+			member.send(cmd, args...)
 		}
 	}
 }
 
-// Function to verify the conditions to safely shutdown the server
-func serverShutdown(finalConn net.Conn) {
-	var shutdown string
-	// If all clients have left... (Note this is never called when the server is started because no client has disconnected even though there are no clients)
-	if len(connMap) == 0 {
-		if err := finalConn.Close(); err == nil {
-			fmt.Println("Closing final connection...") // Close the connection of the last client
-			finalConn.Close()
-		}
-		fmt.Println("All users have left the chat")
-		fmt.Print("Do you wish to shut down the server ? yes/no : ")
-		fmt.Scanln(&shutdown) // Put the message typed into shutdown
-		if shutdown == "yes" {
-			fmt.Print("Shutting down server...")
-			os.Exit(0) // Server shutdown with no error
+// Broadcast a received message to every other member of the room it was
+// sent to.
+func (h *hub) sendMessageRoom(c *client, room, mess string) {
+	if !h.rooms[room][c] {
+		c.send(proto.Error, "not in room "+room)
+		return
+	}
+	h.broadcastRoom(room, c, proto.Bcast, room, c.username, mess)
+}
+
+// sendPrivateMessage delivers mess to a single user by name, regardless of
+// which room either of them is in.
+func (h *hub) sendPrivateMessage(c *client, toUsername, mess string) {
+	target := h.findClientByUsername(toUsername)
+	if target == nil {
+		c.send(proto.Error, "no such user "+toUsername)
+		return
+	}
+	target.send(proto.PM, c.username, mess)
+}
+
+// findClientByUsername looks up a connected client by its registered
+// username, returning nil if none matches.
+func (h *hub) findClientByUsername(username string) *client {
+	for other := range h.clients {
+		if other.username == username {
+			return other
 		}
 	}
+	return nil
+}
+
+// listRooms returns a comma-separated list of every room currently in use.
+func (h *hub) listRooms() string {
+	names := make([]string, 0, len(h.rooms))
+	for name := range h.rooms {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+// listRoomMembers returns a comma-separated list of the usernames currently
+// in room.
+func (h *hub) listRoomMembers(room string) string {
+	names := make([]string, 0, len(h.rooms[room]))
+	for member := range h.rooms[room] {
+		names = append(names, member.username)
+	}
+	return strings.Join(names, ",")
 }
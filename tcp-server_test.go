@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MaxMichel2/TCChat-Golang/internal/proto"
+)
+
+func init() {
+	// protocolToMessage/authenticate/etc. all log through the package-level
+	// logger, which main would otherwise configure from flags.
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestClient builds a client with a real (but otherwise unused) net.Pipe
+// connection, so dropClient's c.conn.Close() and the hub's logging, which
+// calls c.conn.RemoteAddr(), have something real to act on without a live
+// TCP server. The caller is responsible for closing the returned remote end.
+func newTestClient(h *hub, bufSize int) (c *client, remote net.Conn) {
+	local, remote := net.Pipe()
+	return &client{hub: h, conn: local, outbound: make(chan []byte, bufSize)}, remote
+}
+
+// authenticateAndRegister drives c through the TCCHAT_AUTH/TCCHAT_REGISTER
+// handshake via the hub's normal event pipeline - the same path a real
+// connection's readLoop would use - registering it under username.
+func authenticateAndRegister(h *hub, c *client, username string) {
+	h.inbound <- event{client: c, frame: proto.Frame{Command: proto.Auth, Args: []string{"token", username}}}
+	h.inbound <- event{client: c, frame: proto.Frame{Command: proto.Register, Args: []string{username}}}
+}
+
+// readFrame reads and decodes one EncodeFrame-encoded frame off ch, or fails
+// the test if nothing arrives within timeout.
+func readFrame(t *testing.T, ch <-chan []byte, timeout time.Duration) proto.Frame {
+	t.Helper()
+	select {
+	case raw, ok := <-ch:
+		if !ok {
+			t.Fatalf("outbound channel closed, want a frame")
+			return proto.Frame{}
+		}
+		fields := strings.Split(strings.TrimSuffix(string(raw), "\r\n"), "\t")
+		return proto.Frame{Command: proto.Command(fields[0]), Args: fields[1:]}
+	case <-time.After(timeout):
+		t.Fatalf("timed out waiting for a frame")
+		return proto.Frame{}
+	}
+}
+
+// expectOutboundClosed drains any frames still buffered in ch and fails the
+// test unless it's eventually closed within timeout.
+func expectOutboundClosed(t *testing.T, ch <-chan []byte, timeout time.Duration) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("outbound channel was not closed")
+		}
+	}
+}
+
+// A client whose outbound queue never drains (simulating a stalled writer
+// goroutine) must be evicted rather than allowed to block the hub, per
+// client.send's contract.
+func TestHubEvictsSlowClientWhenOutboundBufferFills(t *testing.T) {
+	h := newHub(noAuth{}, 1, time.Second)
+	shutdown := make(chan struct{})
+	go h.run(shutdown, 0)
+	defer close(shutdown)
+
+	c, remote := newTestClient(h, h.bufferSize)
+	defer remote.Close()
+	h.register <- c
+
+	// Nothing reads c.outbound here, so the TCCHAT_AUTH_OK sent on
+	// authentication fills its one-slot buffer; the TCCHAT_WELCOME that
+	// authenticateAndRegister's TCCHAT_REGISTER triggers next can't be
+	// queued, and the hub must evict c instead of blocking on it.
+	authenticateAndRegister(h, c, "slow")
+
+	expectOutboundClosed(t, c.outbound, time.Second)
+}
+
+// dropClient is reached both from readLoop's unregister on connection error
+// and from writeLoop's unregister on a failed write, so the same client can
+// be unregistered twice in quick succession; the second call must be a
+// no-op rather than double-closing c.outbound.
+func TestHubDropClientIsIdempotent(t *testing.T) {
+	h := newHub(noAuth{}, 4, time.Second)
+	shutdown := make(chan struct{})
+	go h.run(shutdown, 0)
+	defer close(shutdown)
+
+	c, remote := newTestClient(h, h.bufferSize)
+	defer remote.Close()
+	h.register <- c
+	authenticateAndRegister(h, c, "alice")
+
+	h.unregister <- c
+	expectOutboundClosed(t, c.outbound, time.Second)
+
+	h.unregister <- c // must not panic or double-close c.outbound
+
+	// The hub goroutine must still be alive and servicing other clients.
+	other, otherRemote := newTestClient(h, h.bufferSize)
+	defer otherRemote.Close()
+	h.register <- other
+	authenticateAndRegister(h, other, "bob")
+
+	if frame := readFrame(t, other.outbound, time.Second); frame.Command != proto.AuthOK {
+		t.Errorf("Command = %q, want %q", frame.Command, proto.AuthOK)
+	}
+}
+
+// broadcastShutdown must notify every connected client before closing its
+// connection, giving drainTimeout for that notice to be read off outbound.
+func TestHubBroadcastShutdownNotifiesAndClosesClients(t *testing.T) {
+	h := newHub(noAuth{}, 4, time.Second)
+	drainTimeout := 20 * time.Millisecond
+	shutdown := make(chan struct{})
+	go h.run(shutdown, drainTimeout)
+
+	c, remote := newTestClient(h, h.bufferSize)
+	defer remote.Close()
+	h.register <- c
+	authenticateAndRegister(h, c, "alice")
+
+	// Drain the TCCHAT_AUTH_OK/TCCHAT_WELCOME/TCCHAT_JOIN frames queued by
+	// registering, so only the shutdown notice is left to check.
+	readFrame(t, c.outbound, time.Second)
+	readFrame(t, c.outbound, time.Second)
+	readFrame(t, c.outbound, time.Second)
+
+	close(shutdown)
+
+	if frame := readFrame(t, c.outbound, time.Second); frame.Command != proto.Shutdown {
+		t.Errorf("Command = %q, want %q", frame.Command, proto.Shutdown)
+	}
+
+	// After drainTimeout, run returns having closed every remaining
+	// connection and its outbound queue.
+	expectOutboundClosed(t, c.outbound, time.Second)
+}